@@ -0,0 +1,245 @@
+package main
+
+import (
+    "fmt"
+    "log"
+    "strings"
+
+    "golang.org/x/crypto/bcrypt"
+)
+
+// AccessLevel is a tiered permission level modeled after anonircd's
+// client/registered/vip/moderator/admin/superadmin ladder.
+type AccessLevel int
+
+const (
+    LevelClient AccessLevel = iota
+    LevelRegistered
+    LevelVIP
+    LevelModerator
+    LevelAdmin
+    LevelSuperAdmin
+)
+
+func (l AccessLevel) String() string {
+    switch l {
+    case LevelClient:
+        return "client"
+    case LevelRegistered:
+        return "registered"
+    case LevelVIP:
+        return "vip"
+    case LevelModerator:
+        return "moderator"
+    case LevelAdmin:
+        return "admin"
+    case LevelSuperAdmin:
+        return "superadmin"
+    default:
+        return "unknown"
+    }
+}
+
+// accountLevel returns the stored level for an account, or LevelClient if
+// the account does not exist.
+func (bot *TallyBot) accountLevel(account string) AccessLevel {
+    var level int
+    err := bot.db.QueryRow("SELECT level FROM accounts WHERE account = ?", account).Scan(&level)
+    if err != nil {
+        return LevelClient
+    }
+    return AccessLevel(level)
+}
+
+// identifiedAccount returns the account a nick has IDENTIFY'd as this
+// session, if any. identified is shared across every network's bot, so
+// access goes through bot.mu like activeChannels/network/appConfig.
+func (bot *TallyBot) identifiedAccount(nick string) (string, bool) {
+    bot.mu.RLock()
+    defer bot.mu.RUnlock()
+    account, ok := bot.identified[nick]
+    return account, ok
+}
+
+// setIdentified records that nick has identified as account.
+func (bot *TallyBot) setIdentified(nick, account string) {
+    bot.mu.Lock()
+    defer bot.mu.Unlock()
+    bot.identified[nick] = account
+}
+
+// levelFor resolves the effective access level for a nick in a channel,
+// taking channel-founder status into account.
+func (bot *TallyBot) levelFor(nick, channel string) AccessLevel {
+    account, ok := bot.identifiedAccount(nick)
+    if !ok {
+        return LevelClient
+    }
+    level := bot.accountLevel(account)
+    if founder, ok := bot.channelFounder(channel); ok && founder == account && level < LevelModerator {
+        level = LevelModerator
+    }
+    return level
+}
+
+func (bot *TallyBot) requireLevel(channel, nick string, min AccessLevel) bool {
+    return bot.levelFor(nick, channel) >= min
+}
+
+// parseLevel parses an access level name (e.g. "admin") into its
+// AccessLevel, for the -grant CLI flag.
+func parseLevel(name string) (AccessLevel, error) {
+    switch strings.ToLower(name) {
+    case "client":
+        return LevelClient, nil
+    case "registered":
+        return LevelRegistered, nil
+    case "vip":
+        return LevelVIP, nil
+    case "moderator":
+        return LevelModerator, nil
+    case "admin":
+        return LevelAdmin, nil
+    case "superadmin":
+        return LevelSuperAdmin, nil
+    default:
+        return LevelClient, fmt.Errorf("unknown access level %q", name)
+    }
+}
+
+// setAccountLevel sets account's level, failing if the account has not
+// been registered yet. This is the only way to reach LevelAdmin or
+// LevelSuperAdmin: !register always grants LevelRegistered, so every
+// deploy needs the -grant CLI flag run once to bootstrap its first admin.
+func (bot *TallyBot) setAccountLevel(account string, level AccessLevel) error {
+    res, err := bot.db.Exec("UPDATE accounts SET level = ? WHERE account = ?", level, account)
+    if err != nil {
+        return err
+    }
+    rows, err := res.RowsAffected()
+    if err != nil {
+        return err
+    }
+    if rows == 0 {
+        return fmt.Errorf("no such account %s; register it with !register first", account)
+    }
+    return nil
+}
+
+func (bot *TallyBot) registerAccount(account, password string) error {
+    var count int
+    err := bot.db.QueryRow("SELECT COUNT(*) FROM accounts WHERE account = ?", account).Scan(&count)
+    if err != nil {
+        return err
+    }
+    if count > 0 {
+        return fmt.Errorf("account %s is already registered", account)
+    }
+    hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+    if err != nil {
+        return err
+    }
+    _, err = bot.db.Exec("INSERT INTO accounts (account, password_hash, level) VALUES (?, ?, ?)",
+        account, string(hash), LevelRegistered)
+    return err
+}
+
+func (bot *TallyBot) identifyAccount(nick, account, password string) error {
+    var hash string
+    err := bot.db.QueryRow("SELECT password_hash FROM accounts WHERE account = ?", account).Scan(&hash)
+    if err != nil {
+        return fmt.Errorf("no such account %s", account)
+    }
+    if err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)); err != nil {
+        return fmt.Errorf("incorrect password")
+    }
+    bot.setIdentified(nick, account)
+    return nil
+}
+
+func (bot *TallyBot) channelFounder(channel string) (string, bool) {
+    var account string
+    err := bot.db.QueryRow("SELECT account FROM channel_founders WHERE channel = ?", channel).Scan(&account)
+    if err != nil {
+        return "", false
+    }
+    return account, true
+}
+
+func (bot *TallyBot) foundChannel(channel, account string) error {
+    if _, ok := bot.channelFounder(channel); ok {
+        return fmt.Errorf("%s already has a founder", channel)
+    }
+    _, err := bot.db.Exec("INSERT INTO channel_founders (channel, account) VALUES (?, ?)", channel, account)
+    return err
+}
+
+func (bot *TallyBot) isBanned(item string) bool {
+    var count int
+    err := bot.db.QueryRow("SELECT COUNT(*) FROM banned_items WHERE item = ?", item).Scan(&count)
+    if err != nil {
+        log.Println(err)
+        return false
+    }
+    return count > 0
+}
+
+func (bot *TallyBot) banItem(item string) error {
+    _, err := bot.db.Exec("INSERT OR IGNORE INTO banned_items (item) VALUES (?)", item)
+    return err
+}
+
+func (bot *TallyBot) resetItem(item, channel string) error {
+    _, err := bot.db.Exec("UPDATE tallies SET score = 0 WHERE item = ? AND channel = ?", item, channel)
+    return err
+}
+
+// mergeItems folds item2's score in channel into item1 and drops item2
+// from that channel. item2 keeps any scores it holds in other channels;
+// if it has no tally row left in any channel its alias entry is dropped.
+func (bot *TallyBot) mergeItems(item1, item2, channel string) error {
+    bot.ensureItemExists(item1, channel)
+    bot.ensureItemExists(item2, channel)
+    total := bot.getScore(item1, channel) + bot.getScore(item2, channel)
+    bot.updateScore(item1, channel, total)
+    if _, err := bot.db.Exec("DELETE FROM tallies WHERE item = ? AND channel = ?", item2, channel); err != nil {
+        return err
+    }
+    return bot.dropAliasIfOrphaned(item2)
+}
+
+// kickItem removes item from channel entirely. Once an item has no tally
+// row left in any channel its alias entry is dropped too.
+func (bot *TallyBot) kickItem(item, channel string) error {
+    if _, err := bot.db.Exec("DELETE FROM tallies WHERE item = ? AND channel = ?", item, channel); err != nil {
+        return err
+    }
+    return bot.dropAliasIfOrphaned(item)
+}
+
+func (bot *TallyBot) dropAliasIfOrphaned(item string) error {
+    if bot.hasAnyTally(item) {
+        return nil
+    }
+    bot.deindexItem(item)
+    _, err := bot.db.Exec("DELETE FROM aliases WHERE item = ?", item)
+    return err
+}
+
+func (bot *TallyBot) itemCount() int {
+    var count int
+    if err := bot.db.QueryRow("SELECT COUNT(DISTINCT item) FROM tallies").Scan(&count); err != nil {
+        log.Println(err)
+        return 0
+    }
+    return count
+}
+
+func (bot *TallyBot) accountCount() int {
+    var count int
+    if err := bot.db.QueryRow("SELECT COUNT(*) FROM accounts").Scan(&count); err != nil {
+        log.Println(err)
+        return 0
+    }
+    return count
+}
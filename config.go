@@ -0,0 +1,193 @@
+package main
+
+import (
+    "fmt"
+    "log"
+    "os"
+    "path/filepath"
+    "strings"
+
+    "github.com/BurntSushi/toml"
+)
+
+// configFileName is looked for in the current directory first, then in
+// the user's home directory.
+const configFileName = ".tally.conf"
+
+// NetworkConfig is one [[network]] block: a single IRC server connection
+// and the channels the bot joins and actively responds in on it.
+type NetworkConfig struct {
+    Name           string   `toml:"name"`
+    Nickname       string   `toml:"nickname"`
+    Server         string   `toml:"server"`
+    Channels       []string `toml:"channels"`
+    ActiveChannels []string `toml:"active_channels"`
+    UseTLS         bool     `toml:"use_tls"`
+    SASLUser       string   `toml:"sasl_user"`
+    SASLPass       string   `toml:"sasl_pass"`
+    SASLMech       string   `toml:"sasl_mech"`
+    SASLCertFile   string   `toml:"sasl_cert_file"`
+    SASLKeyFile    string   `toml:"sasl_key_file"`
+    NickServPass   string   `toml:"nickserv_pass"`
+}
+
+// Config is the top-level TOML document: one or more networks sharing a
+// single tally database.
+type Config struct {
+    Networks               []NetworkConfig `toml:"network"`
+    DefaultChannel          string          `toml:"default_channel"`
+    SplitChannelsOnMigrate  bool            `toml:"split_channels_on_migrate"`
+    HTTPListen              string          `toml:"http_listen"`
+}
+
+// allActiveChannels returns the union of every network's active channels,
+// for migrations and other code that needs a channel list without caring
+// which network it came from.
+func (c Config) allActiveChannels() []string {
+    seen := make(map[string]bool)
+    var channels []string
+    for _, n := range c.Networks {
+        for _, ch := range n.ActiveChannels {
+            if !seen[ch] {
+                seen[ch] = true
+                channels = append(channels, ch)
+            }
+        }
+    }
+    return channels
+}
+
+// networkNamed returns the network block matching name, if any.
+func (c Config) networkNamed(name string) (NetworkConfig, bool) {
+    for _, n := range c.Networks {
+        if n.Name == name {
+            return n, true
+        }
+    }
+    return NetworkConfig{}, false
+}
+
+// readConfig loads the TOML config from ./.tally.conf, falling back to
+// ~/.tally.conf, and fills in defaults for anything left unset.
+func readConfig() (Config, error) {
+    path, err := configPath()
+    if err != nil {
+        return Config{}, err
+    }
+
+    var config Config
+    if _, err := toml.DecodeFile(path, &config); err != nil {
+        return Config{}, fmt.Errorf("parsing %s: %w", path, err)
+    }
+
+    if len(config.Networks) == 0 {
+        return Config{}, fmt.Errorf("%s defines no [[network]] blocks", path)
+    }
+
+    for i := range config.Networks {
+        applyNetworkDefaults(&config.Networks[i])
+    }
+
+    if config.DefaultChannel == "" {
+        config.DefaultChannel = config.Networks[0].Channels[0]
+    }
+
+    return config, nil
+}
+
+func applyNetworkDefaults(n *NetworkConfig) {
+    if n.Nickname == "" {
+        n.Nickname = "TallyBot"
+    }
+    if n.Server == "" {
+        n.Server = "irc.libera.chat:6667"
+    }
+    if len(n.Channels) == 0 {
+        n.Channels = []string{"#tallybot"}
+    }
+    if len(n.ActiveChannels) == 0 {
+        n.ActiveChannels = n.Channels
+    }
+    if n.Name == "" {
+        n.Name = n.Server
+    }
+}
+
+func configPath() (string, error) {
+    if _, err := os.Stat(configFileName); err == nil {
+        return configFileName, nil
+    }
+    home, err := os.UserHomeDir()
+    if err != nil {
+        return "", fmt.Errorf("locating %s: %w", configFileName, err)
+    }
+    return filepath.Join(home, configFileName), nil
+}
+
+// rehash reloads this bot's own [[network]] block from newConfig, joining
+// and parting channels to match, and reconnects only if the server
+// changed. Tally state lives in the shared database and is untouched.
+func (bot *TallyBot) rehash(newConfig Config) error {
+    bot.mu.Lock()
+    oldNet := bot.network
+    newNet, ok := newConfig.networkNamed(oldNet.Name)
+    if !ok {
+        bot.mu.Unlock()
+        return fmt.Errorf("network %s is no longer configured", oldNet.Name)
+    }
+
+    oldChannels := make(map[string]bool)
+    for _, ch := range oldNet.Channels {
+        oldChannels[ch] = true
+    }
+    newChannels := make(map[string]bool)
+    for _, ch := range newNet.Channels {
+        newChannels[ch] = true
+    }
+
+    activeMap := make(map[string]bool)
+    for _, ch := range newNet.ActiveChannels {
+        activeMap[strings.ToLower(ch)] = true
+    }
+    bot.activeChannels = activeMap
+    bot.network = newNet
+    bot.appConfig = newConfig
+    bot.mu.Unlock()
+
+    for ch := range oldChannels {
+        if !newChannels[ch] {
+            bot.conn.Part(ch)
+        }
+    }
+    for ch := range newChannels {
+        if !oldChannels[ch] {
+            bot.conn.Join(ch)
+        }
+    }
+
+    if newNet.Server != oldNet.Server {
+        log.Printf("rehashing to new server: %s", newNet.Server)
+
+        // The connection goroutine spawned in main() is blocked in
+        // conn.Loop() on the old connection; Quit ends it, then this
+        // goroutine takes over driving Connect+Loop on the new server.
+        // Register with the same WaitGroup main() is blocked on before
+        // calling Quit, so the count never drops to zero in between and
+        // wg.Wait() can't return while this reconnect is still pending.
+        if bot.wg != nil {
+            bot.wg.Add(1)
+        }
+        bot.conn.Quit()
+        go func() {
+            if bot.wg != nil {
+                defer bot.wg.Done()
+            }
+            if err := bot.conn.Connect(newNet.Server); err != nil {
+                log.Printf("Reconnect to %s failed: %s", newNet.Server, err)
+                return
+            }
+            bot.conn.Loop()
+        }()
+    }
+    return nil
+}
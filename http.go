@@ -0,0 +1,195 @@
+package main
+
+import (
+    "encoding/json"
+    "fmt"
+    "html"
+    "net/http"
+    "strconv"
+    "strings"
+    "sync/atomic"
+    "time"
+)
+
+// metrics tracks the lightweight counters exposed at /metrics.
+type metrics struct {
+    messages   uint64
+    dbCalls    uint64
+    dbLatency  uint64 // nanoseconds, accumulated
+}
+
+func newMetrics() *metrics {
+    return &metrics{}
+}
+
+func (m *metrics) recordMessage() {
+    atomic.AddUint64(&m.messages, 1)
+}
+
+// timeDB records how long a DB call took. Call as
+// `defer bot.metrics.timeDB(time.Now())`.
+func (m *metrics) timeDB(start time.Time) {
+    atomic.AddUint64(&m.dbCalls, 1)
+    atomic.AddUint64(&m.dbLatency, uint64(time.Since(start).Nanoseconds()))
+}
+
+func (m *metrics) avgDBLatencySeconds() float64 {
+    calls := atomic.LoadUint64(&m.dbCalls)
+    if calls == 0 {
+        return 0
+    }
+    return float64(atomic.LoadUint64(&m.dbLatency)) / float64(calls) / 1e9
+}
+
+type apiItem struct {
+    Item  string `json:"item"`
+    Score int    `json:"score"`
+}
+
+type apiLogEntry struct {
+    Timestamp int64  `json:"timestamp"`
+    Nick      string `json:"nick"`
+    Channel   string `json:"channel"`
+    Item      string `json:"item"`
+    Action    string `json:"action"`
+    Delta     int    `json:"delta"`
+    Score     int    `json:"score"`
+}
+
+// serveHTTP blocks serving the JSON API, HTML leaderboard, and /metrics
+// endpoint on addr. Run it in its own goroutine.
+func (bot *TallyBot) serveHTTP(addr string) {
+    mux := http.NewServeMux()
+    mux.HandleFunc("/api/top", bot.handleAPITop)
+    mux.HandleFunc("/api/item/", bot.handleAPIItem)
+    mux.HandleFunc("/api/linked/", bot.handleAPILinked)
+    mux.HandleFunc("/api/log", bot.handleAPILog)
+    mux.HandleFunc("/metrics", bot.handleMetrics)
+    mux.HandleFunc("/", bot.handleLeaderboardHTML)
+
+    if err := http.ListenAndServe(addr, mux); err != nil {
+        fmt.Printf("HTTP server stopped: %v\n", err)
+    }
+}
+
+func (bot *TallyBot) channelParam(r *http.Request) string {
+    if ch := r.URL.Query().Get("channel"); ch != "" {
+        return ch
+    }
+    bot.mu.RLock()
+    defer bot.mu.RUnlock()
+    return bot.appConfig.DefaultChannel
+}
+
+func (bot *TallyBot) handleAPITop(w http.ResponseWriter, r *http.Request) {
+    n := 10
+    if raw := r.URL.Query().Get("n"); raw != "" {
+        if parsed, err := strconv.Atoi(raw); err == nil {
+            n = parsed
+        }
+    }
+    items, scores := bot.getChannelLeaderboard(bot.channelParam(r), n)
+    result := make([]apiItem, len(items))
+    for i, item := range items {
+        result[i] = apiItem{Item: item, Score: scores[i]}
+    }
+    writeJSON(w, result)
+}
+
+func (bot *TallyBot) handleAPIItem(w http.ResponseWriter, r *http.Request) {
+    item := strings.TrimPrefix(r.URL.Path, "/api/item/")
+    if item == "" {
+        http.NotFound(w, r)
+        return
+    }
+    channel := bot.channelParam(r)
+    writeJSON(w, map[string]interface{}{
+        "item":         item,
+        "channel":      channel,
+        "score":        bot.getScore(item, channel),
+        "global_total": bot.getGlobalTotalScore(item),
+    })
+}
+
+func (bot *TallyBot) handleAPILinked(w http.ResponseWriter, r *http.Request) {
+    item := strings.TrimPrefix(r.URL.Path, "/api/linked/")
+    if item == "" {
+        http.NotFound(w, r)
+        return
+    }
+    writeJSON(w, bot.getLinkedItems(item))
+}
+
+func (bot *TallyBot) handleAPILog(w http.ResponseWriter, r *http.Request) {
+    item := r.URL.Query().Get("item")
+    if item == "" {
+        http.Error(w, "item is required", http.StatusBadRequest)
+        return
+    }
+    page := 1
+    if raw := r.URL.Query().Get("page"); raw != "" {
+        if parsed, err := strconv.Atoi(raw); err == nil {
+            page = parsed
+        }
+    }
+    action := parseAction(r.URL.Query().Get("action"))
+    entries, err := bot.revealLog(item, page, action)
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+    result := make([]apiLogEntry, len(entries))
+    for i, e := range entries {
+        result[i] = apiLogEntry{Timestamp: e.ts, Nick: e.nick, Channel: e.channel, Item: e.item, Action: e.action, Delta: e.delta, Score: e.score}
+    }
+    writeJSON(w, result)
+}
+
+func (bot *TallyBot) handleMetrics(w http.ResponseWriter, r *http.Request) {
+    fmt.Fprintf(w, "# HELP tallybot_messages_total Total IRC messages processed\n")
+    fmt.Fprintf(w, "# TYPE tallybot_messages_total counter\n")
+    fmt.Fprintf(w, "tallybot_messages_total %d\n", atomic.LoadUint64(&bot.metrics.messages))
+
+    fmt.Fprintf(w, "# HELP tallybot_db_latency_seconds Average DB call latency in seconds\n")
+    fmt.Fprintf(w, "# TYPE tallybot_db_latency_seconds gauge\n")
+    fmt.Fprintf(w, "tallybot_db_latency_seconds %f\n", bot.metrics.avgDBLatencySeconds())
+
+    bot.mu.RLock()
+    activeChannels := len(bot.activeChannels)
+    bot.mu.RUnlock()
+    fmt.Fprintf(w, "# HELP tallybot_active_channels Number of channels the bot actively responds in\n")
+    fmt.Fprintf(w, "# TYPE tallybot_active_channels gauge\n")
+    fmt.Fprintf(w, "tallybot_active_channels %d\n", activeChannels)
+
+    fmt.Fprintf(w, "# HELP tallybot_items_total Number of tracked items\n")
+    fmt.Fprintf(w, "# TYPE tallybot_items_total gauge\n")
+    fmt.Fprintf(w, "tallybot_items_total %d\n", bot.itemCount())
+}
+
+func (bot *TallyBot) handleLeaderboardHTML(w http.ResponseWriter, r *http.Request) {
+    channel := bot.channelParam(r)
+    if ch := strings.TrimPrefix(r.URL.Path, "/channel/"); ch != r.URL.Path {
+        channel = ch
+    } else if r.URL.Path != "/" {
+        http.NotFound(w, r)
+        return
+    }
+
+    items, scores := bot.getChannelLeaderboard(channel, 25)
+    safeChannel := html.EscapeString(channel)
+    w.Header().Set("Content-Type", "text/html; charset=utf-8")
+    fmt.Fprintf(w, "<html><head><title>TallyBot: %s</title></head><body>\n", safeChannel)
+    fmt.Fprintf(w, "<h1>Leaderboard for %s</h1>\n<table border=\"1\">\n<tr><th>Item</th><th>Score</th></tr>\n", safeChannel)
+    for i, item := range items {
+        fmt.Fprintf(w, "<tr><td>%s</td><td>%d</td></tr>\n", html.EscapeString(item), scores[i])
+    }
+    fmt.Fprintf(w, "</table>\n</body></html>\n")
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+    w.Header().Set("Content-Type", "application/json")
+    w.Header().Set("X-Content-Type-Options", "nosniff")
+    if err := json.NewEncoder(w).Encode(v); err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+    }
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+    "encoding/hex"
+    "fmt"
+    "log"
+    "strings"
+    "time"
+
+    "golang.org/x/crypto/sha3"
+)
+
+// undoWindow bounds how long after a ++/-- a user may !undo it.
+const undoWindow = 5 * time.Minute
+
+const logPageSize = 10
+
+// hashHostmask returns a stable, non-reversible fingerprint for a
+// user@host string, so !reveal can be shared without leaking real hosts.
+func hashHostmask(hostmask string) string {
+    sum := sha3.Sum256([]byte(hostmask))
+    return hex.EncodeToString(sum[:])
+}
+
+// logTally records a ++/--/link/unlink/undo event to the auditable tally
+// log.
+func (bot *TallyBot) logTally(nick, hostmask, channel, item, action string, delta, score int) {
+    _, err := bot.db.Exec(
+        `INSERT INTO tally_log (ts, nick, iphash, channel, item, action, delta, score, undone)
+         VALUES (?, ?, ?, ?, ?, ?, ?, ?, 0)`,
+        time.Now().Unix(), nick, hashHostmask(hostmask), channel, item, action, delta, score,
+    )
+    if err != nil {
+        log.Println(err)
+    }
+}
+
+type tallyLogEntry struct {
+    id      int64
+    ts      int64
+    nick    string
+    channel string
+    item    string
+    action  string
+    delta   int
+    score   int
+}
+
+// revealLog returns one page (10 entries, newest first) of the tally log
+// for item, optionally filtered to a single action type.
+func (bot *TallyBot) revealLog(item string, page int, action string) ([]tallyLogEntry, error) {
+    if page < 1 {
+        page = 1
+    }
+    query := "SELECT id, ts, nick, channel, item, action, delta, score FROM tally_log WHERE item = ?"
+    args := []interface{}{item}
+    if action != "" {
+        query += " AND action = ?"
+        args = append(args, action)
+    }
+    query += " ORDER BY id DESC LIMIT ? OFFSET ?"
+    args = append(args, logPageSize, (page-1)*logPageSize)
+
+    rows, err := bot.db.Query(query, args...)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    var entries []tallyLogEntry
+    for rows.Next() {
+        var e tallyLogEntry
+        if err := rows.Scan(&e.id, &e.ts, &e.nick, &e.channel, &e.item, &e.action, &e.delta, &e.score); err != nil {
+            return nil, err
+        }
+        entries = append(entries, e)
+    }
+    return entries, nil
+}
+
+func formatLogEntry(e tallyLogEntry) string {
+    return fmt.Sprintf("[%s] %s %s%d on %s (%s) -> %d",
+        time.Unix(e.ts, 0).UTC().Format("2006-01-02 15:04"), e.nick, signed(e.delta), e.delta, e.item, e.action, e.score)
+}
+
+func signed(n int) string {
+    if n >= 0 {
+        return "+"
+    }
+    return ""
+}
+
+// whoScored returns the nicks with the largest absolute contribution to
+// item's score, highest first.
+func (bot *TallyBot) whoScored(item string, limit int) ([]string, []int, error) {
+    rows, err := bot.db.Query(
+        `SELECT nick, SUM(delta) as total FROM tally_log
+         WHERE item = ? AND action IN ('increment', 'decrement')
+         GROUP BY nick ORDER BY ABS(SUM(delta)) DESC LIMIT ?`, item, limit)
+    if err != nil {
+        return nil, nil, err
+    }
+    defer rows.Close()
+
+    var nicks []string
+    var totals []int
+    for rows.Next() {
+        var nick string
+        var total int
+        if err := rows.Scan(&nick, &total); err != nil {
+            return nil, nil, err
+        }
+        nicks = append(nicks, nick)
+        totals = append(totals, total)
+    }
+    return nicks, totals, nil
+}
+
+// undoLast reverses the most recent still-live ++/-- the nick made in
+// channel within undoWindow, returning the affected item.
+func (bot *TallyBot) undoLast(nick, hostmask, channel string) (string, error) {
+    var id int64
+    var item string
+    var delta int
+    cutoff := time.Now().Add(-undoWindow).Unix()
+    err := bot.db.QueryRow(
+        `SELECT id, item, delta FROM tally_log
+         WHERE nick = ? AND channel = ? AND action IN ('increment', 'decrement') AND undone = 0 AND ts >= ?
+         ORDER BY id DESC LIMIT 1`, nick, channel, cutoff).Scan(&id, &item, &delta)
+    if err != nil {
+        return "", fmt.Errorf("nothing to undo")
+    }
+
+    newScore := bot.getScore(item, channel) - delta
+    bot.updateScore(item, channel, newScore)
+
+    if _, err := bot.db.Exec("UPDATE tally_log SET undone = 1 WHERE id = ?", id); err != nil {
+        return "", err
+    }
+    bot.logTally(nick, hostmask, channel, item, "undo", -delta, newScore)
+    return item, nil
+}
+
+func parseAction(action string) string {
+    switch strings.ToLower(action) {
+    case "link", "unlink", "increment", "decrement", "undo":
+        return strings.ToLower(action)
+    case "++":
+        return "increment"
+    case "--":
+        return "decrement"
+    default:
+        return ""
+    }
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+    "database/sql"
+    "log"
+    "strings"
+)
+
+// initMaskIndex opens an in-memory SQLite index of item names for fast
+// glob lookups, the way ergonomadic indexes user masks: the main tallies
+// table scales fine for exact lookups, but a LIKE scan over every row on
+// every !match gets expensive once the tally set grows, so item names are
+// mirrored into a dedicated :memory: table kept current on every write.
+func (bot *TallyBot) initMaskIndex() error {
+    db, err := sql.Open("sqlite3", ":memory:")
+    if err != nil {
+        return err
+    }
+    if _, err := db.Exec(`CREATE TABLE mask (item TEXT PRIMARY KEY);`); err != nil {
+        return err
+    }
+    bot.maskDB = db
+
+    rows, err := bot.db.Query("SELECT DISTINCT item FROM tallies")
+    if err != nil {
+        return err
+    }
+    defer rows.Close()
+    for rows.Next() {
+        var item string
+        if err := rows.Scan(&item); err != nil {
+            return err
+        }
+        bot.indexItem(item)
+    }
+    return rows.Err()
+}
+
+func (bot *TallyBot) indexItem(item string) {
+    if _, err := bot.maskDB.Exec("INSERT OR IGNORE INTO mask (item) VALUES (?)", item); err != nil {
+        log.Println(err)
+    }
+}
+
+func (bot *TallyBot) deindexItem(item string) {
+    if _, err := bot.maskDB.Exec("DELETE FROM mask WHERE item = ?", item); err != nil {
+        log.Println(err)
+    }
+}
+
+// globToLike converts a shell-style glob (* and ?) into a SQL LIKE
+// pattern, escaping any literal %, _, or \ already present in the glob.
+func globToLike(glob string) string {
+    var b strings.Builder
+    for _, r := range glob {
+        switch r {
+        case '%', '_', '\\':
+            b.WriteByte('\\')
+            b.WriteRune(r)
+        case '*':
+            b.WriteByte('%')
+        case '?':
+            b.WriteByte('_')
+        default:
+            b.WriteRune(r)
+        }
+    }
+    return b.String()
+}
+
+func isGlob(s string) bool {
+    return strings.ContainsAny(s, "*?")
+}
+
+// matchItems returns every indexed item matching glob, in ascending order.
+func (bot *TallyBot) matchItems(glob string) ([]string, error) {
+    rows, err := bot.maskDB.Query("SELECT item FROM mask WHERE item LIKE ? ESCAPE '\\' ORDER BY item", globToLike(glob))
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    var items []string
+    for rows.Next() {
+        var item string
+        if err := rows.Scan(&item); err != nil {
+            return nil, err
+        }
+        items = append(items, item)
+    }
+    return items, rows.Err()
+}
+
+// resolveItems expands pattern into the list of items it names: a literal
+// item if it contains no glob characters, or every indexed match if it does.
+func (bot *TallyBot) resolveItems(pattern string) ([]string, error) {
+    if !isGlob(pattern) {
+        return []string{pattern}, nil
+    }
+    return bot.matchItems(pattern)
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+    "database/sql"
+    "fmt"
+)
+
+// migration is one ordered, idempotent schema step. Migrations are never
+// edited once released; schema changes land as a new migration with the
+// next version number.
+type migration struct {
+    version     int
+    description string
+    apply       func(*TallyBot) error
+}
+
+var migrations = []migration{
+    {1, "create tallies, aliases, and groups tables", migrateCreateTallies},
+    {2, "create accounts, channel_founders, and banned_items tables", migrateCreateAccounts},
+    {3, "add channel column to tallies for per-channel score isolation", migrateChannelColumn},
+    {4, "create tally_log table for auditable history", migrateCreateTallyLog},
+}
+
+func migrateCreateTallies(bot *TallyBot) error {
+    statements := []string{
+        `CREATE TABLE IF NOT EXISTS tallies (
+            item TEXT PRIMARY KEY,
+            score INTEGER
+        );`,
+        `CREATE TABLE IF NOT EXISTS aliases (
+            item TEXT PRIMARY KEY,
+            group_id INTEGER
+        );`,
+        `CREATE TABLE IF NOT EXISTS groups (
+            group_id INTEGER PRIMARY KEY AUTOINCREMENT
+        );`,
+    }
+    return execAll(bot.db, statements)
+}
+
+func migrateCreateAccounts(bot *TallyBot) error {
+    statements := []string{
+        `CREATE TABLE IF NOT EXISTS accounts (
+            account TEXT PRIMARY KEY,
+            password_hash TEXT,
+            level INTEGER NOT NULL DEFAULT 0
+        );`,
+        `CREATE TABLE IF NOT EXISTS channel_founders (
+            channel TEXT PRIMARY KEY,
+            account TEXT NOT NULL
+        );`,
+        `CREATE TABLE IF NOT EXISTS banned_items (
+            item TEXT PRIMARY KEY
+        );`,
+    }
+    return execAll(bot.db, statements)
+}
+
+// migrateChannelColumn rebuilds tallies with a compound (item, channel)
+// key so scores no longer leak between channels. Existing scores are
+// preserved either under appConfig.DefaultChannel, or duplicated into
+// every configured active channel when appConfig.SplitChannelsOnMigrate
+// is set.
+func migrateChannelColumn(bot *TallyBot) error {
+    db := bot.db
+    if _, err := db.Exec(`
+        CREATE TABLE IF NOT EXISTS tallies_v2 (
+            item TEXT NOT NULL,
+            channel TEXT NOT NULL,
+            score INTEGER NOT NULL DEFAULT 0,
+            PRIMARY KEY (item, channel)
+        );`); err != nil {
+        return err
+    }
+
+    channels := bot.appConfig.allActiveChannels()
+    if !bot.appConfig.SplitChannelsOnMigrate || len(channels) == 0 {
+        defaultChannel := bot.appConfig.DefaultChannel
+        if defaultChannel == "" {
+            defaultChannel = "#general"
+        }
+        channels = []string{defaultChannel}
+    }
+
+    for _, ch := range channels {
+        if _, err := db.Exec(
+            "INSERT OR IGNORE INTO tallies_v2 (item, channel, score) SELECT item, ?, score FROM tallies", ch,
+        ); err != nil {
+            return err
+        }
+    }
+
+    if _, err := db.Exec("DROP TABLE tallies;"); err != nil {
+        return err
+    }
+    if _, err := db.Exec("ALTER TABLE tallies_v2 RENAME TO tallies;"); err != nil {
+        return err
+    }
+    return nil
+}
+
+func migrateCreateTallyLog(bot *TallyBot) error {
+    _, err := bot.db.Exec(`
+        CREATE TABLE IF NOT EXISTS tally_log (
+            id INTEGER PRIMARY KEY AUTOINCREMENT,
+            ts INTEGER NOT NULL,
+            nick TEXT NOT NULL,
+            iphash TEXT NOT NULL,
+            channel TEXT NOT NULL,
+            item TEXT NOT NULL,
+            action TEXT NOT NULL,
+            delta INTEGER NOT NULL,
+            score INTEGER NOT NULL,
+            undone INTEGER NOT NULL DEFAULT 0
+        );`)
+    return err
+}
+
+func execAll(db *sql.DB, statements []string) error {
+    for _, stmt := range statements {
+        if _, err := db.Exec(stmt); err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+// openDB opens the sqlite database at path and ensures the schema_version
+// bookkeeping table exists.
+func openDB(path string) (*sql.DB, error) {
+    db, err := sql.Open("sqlite3", path)
+    if err != nil {
+        return nil, err
+    }
+    _, err = db.Exec(`CREATE TABLE IF NOT EXISTS schema_version (version INTEGER NOT NULL);`)
+    if err != nil {
+        return nil, err
+    }
+    return db, nil
+}
+
+func schemaVersion(db *sql.DB) (int, error) {
+    var version int
+    err := db.QueryRow("SELECT COALESCE(MAX(version), 0) FROM schema_version").Scan(&version)
+    if err != nil {
+        return 0, err
+    }
+    return version, nil
+}
+
+func pendingMigrations(db *sql.DB) ([]migration, error) {
+    current, err := schemaVersion(db)
+    if err != nil {
+        return nil, err
+    }
+    var pending []migration
+    for _, m := range migrations {
+        if m.version > current {
+            pending = append(pending, m)
+        }
+    }
+    return pending, nil
+}
+
+// runMigrations applies every pending migration in order. With dryRun set
+// it only reports what would run.
+func (bot *TallyBot) runMigrations(dryRun bool) error {
+    pending, err := pendingMigrations(bot.db)
+    if err != nil {
+        return err
+    }
+
+    if dryRun {
+        if len(pending) == 0 {
+            fmt.Println("Database is up to date, no pending migrations.")
+            return nil
+        }
+        fmt.Println("Pending migrations:")
+        for _, m := range pending {
+            fmt.Printf("  %d: %s\n", m.version, m.description)
+        }
+        return nil
+    }
+
+    for _, m := range pending {
+        if err := m.apply(bot); err != nil {
+            return fmt.Errorf("migration %d (%s) failed: %w", m.version, m.description, err)
+        }
+        if _, err := bot.db.Exec("INSERT INTO schema_version (version) VALUES (?)", m.version); err != nil {
+            return fmt.Errorf("recording migration %d failed: %w", m.version, err)
+        }
+        fmt.Printf("Applied migration %d: %s\n", m.version, m.description)
+    }
+
+    return nil
+}
@@ -1,134 +1,178 @@
 package main
 
 import (
-    "bufio"
     "crypto/tls"
     "database/sql"
+    "flag"
     "fmt"
     "log"
     "os"
-    "os/user"
-    "path/filepath"
+    "os/signal"
     "regexp"
     "strings"
+    "sync"
+    "syscall"
+    "time"
 
     _ "github.com/mattn/go-sqlite3"
     irc "github.com/thoj/go-ircevent"
 )
 
-type Config struct {
-    Nickname       string
-    Server         string
-    Channels      []string
-    ActiveChannels []string
-    UseTLS        bool
-}
-
 type TallyBot struct {
-    conn           *irc.Connection
-    db             *sql.DB
+    conn *irc.Connection
+    db   *sql.DB
+
+    // mu guards activeChannels, network, and appConfig (which rehash can
+    // rewrite at any time from the SIGHUP goroutine) and identified
+    // (shared across every network's bot and its own connection
+    // goroutine).
+    mu             sync.RWMutex
+    maskDB         *sql.DB
     activeChannels map[string]bool
+    identified     map[string]string
+    network        NetworkConfig
+    appConfig      Config
+    metrics        *metrics
+
+    // wg is the same WaitGroup main() blocks on for every bot; rehash
+    // registers a reconnect goroutine with it so the process can't exit
+    // out from under a bot that is mid-reconnect.
+    wg *sync.WaitGroup
 }
 
-func NewTallyBot(nick, server string, channels []string, activeChannels []string, useTLS bool) *TallyBot {
-    conn := irc.IRC(nick, nick)
-    conn.UseTLS = useTLS
-    if useTLS {
+// NewTallyBot builds the IRC connection for a single [[network]] block.
+// db, maskDB, identified, and metrics are shared across every network and
+// must be attached by the caller before the bot is used.
+func NewTallyBot(network NetworkConfig, appConfig Config) *TallyBot {
+    conn := irc.IRC(network.Nickname, network.Nickname)
+    conn.UseTLS = network.UseTLS
+    if network.UseTLS {
         conn.TLSConfig = &tls.Config{
             InsecureSkipVerify: true,
         }
     }
-    
+
+    // SASL PLAIN authenticates with a login+password; SASL EXTERNAL
+    // authenticates with the TLS client certificate below and carries no
+    // password, so SASLPass is intentionally not required here.
+    if network.SASLUser != "" {
+        conn.UseSASL = true
+        conn.SASLLogin = network.SASLUser
+        conn.SASLPassword = network.SASLPass
+        conn.SASLMech = network.SASLMech
+        if conn.SASLMech == "" {
+            conn.SASLMech = "PLAIN"
+        }
+    }
+
+    if network.SASLCertFile != "" && network.SASLKeyFile != "" {
+        cert, err := tls.LoadX509KeyPair(network.SASLCertFile, network.SASLKeyFile)
+        if err != nil {
+            log.Fatalf("loading SASL EXTERNAL client certificate: %s", err)
+        }
+        conn.UseSASL = true
+        // go-ircevent only wraps the socket in TLS when UseTLS is set, and
+        // EXTERNAL has no meaning without a TLS client certificate, so this
+        // block must force it on rather than relying on a separate use_tls
+        // config key.
+        conn.UseTLS = true
+        if conn.TLSConfig == nil {
+            conn.TLSConfig = &tls.Config{
+                InsecureSkipVerify: true,
+            }
+        }
+        conn.TLSConfig.Certificates = []tls.Certificate{cert}
+        if conn.SASLMech == "" {
+            conn.SASLMech = "EXTERNAL"
+        }
+    }
+
     activeMap := make(map[string]bool)
-    for _, ch := range activeChannels {
-        activeMap[ch] = true
+    for _, ch := range network.ActiveChannels {
+        activeMap[strings.ToLower(ch)] = true
     }
-    
+
     bot := &TallyBot{
         conn:           conn,
         activeChannels: activeMap,
+        identified:     make(map[string]string),
+        network:        network,
+        appConfig:      appConfig,
+        metrics:        newMetrics(),
     }
     return bot
 }
 
-func (bot *TallyBot) initializeDatabase() {
-    var err error
-    bot.db, err = sql.Open("sqlite3", "./tallies.db")
-    if err != nil {
-        log.Fatal(err)
-    }
-
-    statements := []string{
-        `CREATE TABLE IF NOT EXISTS tallies (
-            item TEXT PRIMARY KEY,
-            score INTEGER
-        );`,
-        `CREATE TABLE IF NOT EXISTS aliases (
-            item TEXT PRIMARY KEY,
-            group_id INTEGER
-        );`,
-        `CREATE TABLE IF NOT EXISTS groups (
-            group_id INTEGER PRIMARY KEY AUTOINCREMENT
-        );`,
-    }
+const dbPath = "./tallies.db"
 
-    for _, stmt := range statements {
-        _, err := bot.db.Exec(stmt)
-        if err != nil {
-            log.Fatal(err)
-        }
-    }
-}
-
-func (bot *TallyBot) ensureItemExists(item string) {
+// ensureItemExists makes sure item has a tally row in channel and belongs
+// to an alias group. Alias groups are global: an item shares its links
+// across every channel it appears in, even though its score does not.
+func (bot *TallyBot) ensureItemExists(item, channel string) {
     var count int
-    err := bot.db.QueryRow("SELECT COUNT(*) FROM tallies WHERE item = ?", item).Scan(&count)
+    err := bot.db.QueryRow("SELECT COUNT(*) FROM tallies WHERE item = ? AND channel = ?", item, channel).Scan(&count)
     if err != nil {
         log.Println(err)
         return
     }
-
     if count == 0 {
-        _, err := bot.db.Exec("INSERT INTO tallies (item, score) VALUES (?, 0)", item)
-        if err != nil {
-            log.Println(err)
-            return
-        }
-        res, err := bot.db.Exec("INSERT INTO groups DEFAULT VALUES")
-        if err != nil {
-            log.Println(err)
-            return
-        }
-        groupID, err := res.LastInsertId()
-        if err != nil {
-            log.Println(err)
-            return
-        }
-        _, err = bot.db.Exec("INSERT INTO aliases (item, group_id) VALUES (?, ?)", item, groupID)
+        _, err := bot.db.Exec("INSERT INTO tallies (item, channel, score) VALUES (?, ?, 0)", item, channel)
         if err != nil {
             log.Println(err)
             return
         }
+        bot.indexItem(item)
+    }
+
+    if bot.getGroupID(item) != 0 {
+        return
+    }
+    res, err := bot.db.Exec("INSERT INTO groups DEFAULT VALUES")
+    if err != nil {
+        log.Println(err)
+        return
+    }
+    groupID, err := res.LastInsertId()
+    if err != nil {
+        log.Println(err)
+        return
+    }
+    _, err = bot.db.Exec("INSERT INTO aliases (item, group_id) VALUES (?, ?)", item, groupID)
+    if err != nil {
+        log.Println(err)
+        return
     }
 }
 
-func (bot *TallyBot) getScore(item string) int {
+func (bot *TallyBot) getScore(item, channel string) int {
+    defer bot.metrics.timeDB(time.Now())
     var score int
-    err := bot.db.QueryRow("SELECT score FROM tallies WHERE item = ?", item).Scan(&score)
+    err := bot.db.QueryRow("SELECT score FROM tallies WHERE item = ? AND channel = ?", item, channel).Scan(&score)
     if err != nil {
-        log.Println(err)
         return 0
     }
     return score
 }
 
-func (bot *TallyBot) updateScore(item string, score int) {
-    _, err := bot.db.Exec("UPDATE tallies SET score = ? WHERE item = ?", score, item)
+func (bot *TallyBot) updateScore(item, channel string, score int) {
+    defer bot.metrics.timeDB(time.Now())
+    _, err := bot.db.Exec("UPDATE tallies SET score = ? WHERE item = ? AND channel = ?", score, item, channel)
     if err != nil {
         log.Println(err)
     }
 }
 
+// hasAnyTally reports whether item still has a tally row in any channel.
+func (bot *TallyBot) hasAnyTally(item string) bool {
+    var count int
+    err := bot.db.QueryRow("SELECT COUNT(*) FROM tallies WHERE item = ?", item).Scan(&count)
+    if err != nil {
+        log.Println(err)
+        return true
+    }
+    return count > 0
+}
+
 func (bot *TallyBot) getGroupID(item string) int {
     var groupID int
     err := bot.db.QueryRow("SELECT group_id FROM aliases WHERE item = ?", item).Scan(&groupID)
@@ -138,9 +182,9 @@ func (bot *TallyBot) getGroupID(item string) int {
     return groupID
 }
 
-func (bot *TallyBot) linkItems(item1, item2 string) {
-    bot.ensureItemExists(item1)
-    bot.ensureItemExists(item2)
+func (bot *TallyBot) linkItems(item1, item2, channel string) {
+    bot.ensureItemExists(item1, channel)
+    bot.ensureItemExists(item2, channel)
     group1 := bot.getGroupID(item1)
     group2 := bot.getGroupID(item2)
     if group1 != group2 {
@@ -157,9 +201,9 @@ func (bot *TallyBot) linkItems(item1, item2 string) {
     }
 }
 
-func (bot *TallyBot) unlinkItems(item1, item2 string) {
-    bot.ensureItemExists(item1)
-    bot.ensureItemExists(item2)
+func (bot *TallyBot) unlinkItems(item1, item2, channel string) {
+    bot.ensureItemExists(item1, channel)
+    bot.ensureItemExists(item2, channel)
     group1 := bot.getGroupID(item1)
     group2 := bot.getGroupID(item2)
     if group1 == group2 {
@@ -181,16 +225,18 @@ func (bot *TallyBot) unlinkItems(item1, item2 string) {
     }
 }
 
-func (bot *TallyBot) getTotalScore(item string) int {
+// getChannelTotalScore sums item's score, and the scores of everything it
+// is linked to, within a single channel.
+func (bot *TallyBot) getChannelTotalScore(item, channel string) int {
     groupID := bot.getGroupID(item)
     if groupID == 0 {
-        return bot.getScore(item)
+        return bot.getScore(item, channel)
     }
     var total int
     err := bot.db.QueryRow(`
-        SELECT SUM(score) FROM tallies
+        SELECT COALESCE(SUM(score), 0) FROM tallies
         JOIN aliases USING(item)
-        WHERE group_id = ?`, groupID).Scan(&total)
+        WHERE group_id = ? AND channel = ?`, groupID, channel).Scan(&total)
     if err != nil {
         log.Println(err)
         return 0
@@ -198,6 +244,50 @@ func (bot *TallyBot) getTotalScore(item string) int {
     return total
 }
 
+// getGlobalTotalScore sums item's score, and the scores of everything it
+// is linked to, across every channel.
+func (bot *TallyBot) getGlobalTotalScore(item string) int {
+    groupID := bot.getGroupID(item)
+    var total int
+    var err error
+    if groupID == 0 {
+        err = bot.db.QueryRow("SELECT COALESCE(SUM(score), 0) FROM tallies WHERE item = ?", item).Scan(&total)
+    } else {
+        err = bot.db.QueryRow(`
+            SELECT COALESCE(SUM(score), 0) FROM tallies
+            JOIN aliases USING(item)
+            WHERE group_id = ?`, groupID).Scan(&total)
+    }
+    if err != nil {
+        log.Println(err)
+        return 0
+    }
+    return total
+}
+
+// getChannelLeaderboard returns the top n items by score in channel.
+func (bot *TallyBot) getChannelLeaderboard(channel string, n int) ([]string, []int) {
+    rows, err := bot.db.Query("SELECT item, score FROM tallies WHERE channel = ? ORDER BY score DESC LIMIT ?", channel, n)
+    if err != nil {
+        log.Println(err)
+        return nil, nil
+    }
+    defer rows.Close()
+    var items []string
+    var scores []int
+    for rows.Next() {
+        var item string
+        var score int
+        if err := rows.Scan(&item, &score); err != nil {
+            log.Println(err)
+            continue
+        }
+        items = append(items, item)
+        scores = append(scores, score)
+    }
+    return items, scores
+}
+
 func (bot *TallyBot) getLinkedItems(item string) []string {
     groupID := bot.getGroupID(item)
     if groupID == 0 {
@@ -222,9 +312,22 @@ func (bot *TallyBot) getLinkedItems(item string) []string {
     return items
 }
 
-func (bot *TallyBot) handleMessage(channel, nick, message string) {
+// isActiveChannel reports whether the bot currently responds in channel.
+// Guarded by mu since rehash can replace activeChannels concurrently.
+func (bot *TallyBot) isActiveChannel(channel string) bool {
+    bot.mu.RLock()
+    defer bot.mu.RUnlock()
+    return bot.activeChannels[channel]
+}
+
+func (bot *TallyBot) handleMessage(channel, nick, hostmask, message string) {
+    bot.metrics.recordMessage()
+    // IRC channel names are case-insensitive; normalize once here so
+    // tallies, founders, and active-channel lookups agree no matter what
+    // case the server or a command argument used.
+    channel = strings.ToLower(channel)
     isPM := !strings.HasPrefix(channel, "#")
-    if !isPM && !bot.activeChannels[channel] {
+    if !isPM && !bot.isActiveChannel(channel) {
         return
     }
 
@@ -232,60 +335,364 @@ func (bot *TallyBot) handleMessage(channel, nick, message string) {
     messageLower := strings.ToLower(message)
 
     helpRegex := regexp.MustCompile(`^!help$`)
-    linkRegex := regexp.MustCompile(`^!link ([\w\.]+) ([\w\.]+)$`)
+    linkRegex := regexp.MustCompile(`^!link ([\w\.\*\?]+) ([\w\.\*\?]+)$`)
+    matchRegex := regexp.MustCompile(`^!match ([\w\.\*\?]+)$`)
     unlinkRegex := regexp.MustCompile(`^!unlink ([\w\.]+) ([\w\.]+)$`)
     totalRegex := regexp.MustCompile(`^!total ([\w\.]+)$`)
+    gtotalRegex := regexp.MustCompile(`^!gtotal ([\w\.]+)$`)
+    topRegex := regexp.MustCompile(`^!top(?: (\d+))?$`)
     upvoteRegex := regexp.MustCompile(`([\w\.]+)(\+\+|--)`)
+    registerRegex := regexp.MustCompile(`(?i)^!register (\S+)$`)
+    identifyRegex := regexp.MustCompile(`(?i)^!identify (\S+)$`)
+    foundRegex := regexp.MustCompile(`^!found$`)
+    resetRegex := regexp.MustCompile(`^!reset ([\w\.]+)$`)
+    mergeRegex := regexp.MustCompile(`^!merge ([\w\.]+) ([\w\.]+)$`)
+    kickItemRegex := regexp.MustCompile(`^!kick-item ([\w\.]+)$`)
+    banItemRegex := regexp.MustCompile(`^!ban-item ([\w\.]+)$`)
+    statsRegex := regexp.MustCompile(`^!stats$`)
+    rehashRegex := regexp.MustCompile(`^!rehash$`)
+    upgradedbRegex := regexp.MustCompile(`^!upgradedb$`)
+    revealRegex := regexp.MustCompile(`^!reveal ([\w\.]+)(?: (\d+))?(?: (\w+))?$`)
+    whoscoredRegex := regexp.MustCompile(`^!whoscored ([\w\.]+)$`)
+    undoRegex := regexp.MustCompile(`^!undo$`)
 
     if helpMatch := helpRegex.FindStringSubmatch(messageLower); helpMatch != nil {
         help := `Available commands:
 item++ or item--: Increment/decrement score for item
-!link item1 item2: Link two items to share scores
+!link item1 item2: Link two items (or globs, e.g. golang* *bot) to share scores
 !unlink item1 item2: Unlink two items
-!total item: Show total score for item and all linked items`
+!match glob: List items matching a glob (e.g. golang*, *bot)
+!total item: Show total score for item and all linked items in this channel
+!gtotal item: Show total score for item and all linked items across all channels
+!top [n]: Show the top n items in this channel (default 5)
+!register <pass>: Register your nick as an account (use in PM)
+!identify <pass>: Identify to your account (use in PM)
+!found: Become the founder/moderator of the channel you run this in
+!whoscored item: Show top contributors to item
+!undo: Reverse your last ++/-- (within 5 minutes)
+Moderator+: !reset item, !merge item1 item2, !kick-item item, !reveal item [page] [action]
+Admin+: !ban-item item, !stats, !rehash
+Superadmin+: !upgradedb`
         bot.conn.Privmsg(channel, help)
         return
     }
 
+    if registerMatch := registerRegex.FindStringSubmatch(message); registerMatch != nil {
+        if !isPM {
+            bot.conn.Privmsg(channel, "Please !register in a private message so your password isn't shown in the channel.")
+            return
+        }
+        if err := bot.registerAccount(nick, registerMatch[1]); err != nil {
+            bot.conn.Privmsg(channel, fmt.Sprintf("Registration failed: %s", err))
+            return
+        }
+        bot.setIdentified(nick, nick)
+        bot.conn.Privmsg(channel, fmt.Sprintf("Account %s registered and identified.", nick))
+        return
+    }
+
+    if identifyMatch := identifyRegex.FindStringSubmatch(message); identifyMatch != nil {
+        if !isPM {
+            bot.conn.Privmsg(channel, "Please !identify in a private message so your password isn't shown in the channel.")
+            return
+        }
+        if err := bot.identifyAccount(nick, nick, identifyMatch[1]); err != nil {
+            bot.conn.Privmsg(channel, fmt.Sprintf("Identify failed: %s", err))
+            return
+        }
+        bot.conn.Privmsg(channel, fmt.Sprintf("Identified as %s.", nick))
+        return
+    }
+
+    if foundRegex.MatchString(messageLower) {
+        if isPM {
+            bot.conn.Privmsg(channel, "!found must be run in the channel you want to found, not in PM.")
+            return
+        }
+        account, ok := bot.identifiedAccount(nick)
+        if !ok {
+            bot.conn.Privmsg(channel, "You must !identify first.")
+            return
+        }
+        if err := bot.foundChannel(channel, account); err != nil {
+            bot.conn.Privmsg(channel, fmt.Sprintf("Could not found %s: %s", channel, err))
+            return
+        }
+        bot.conn.Privmsg(channel, fmt.Sprintf("%s is now the founder of %s.", nick, channel))
+        return
+    }
+
+    if resetMatch := resetRegex.FindStringSubmatch(messageLower); resetMatch != nil {
+        if !bot.requireLevel(channel, nick, LevelModerator) {
+            bot.conn.Privmsg(channel, "You don't have permission to do that.")
+            return
+        }
+        item := resetMatch[1]
+        bot.resetItem(item, channel)
+        bot.conn.Privmsg(channel, fmt.Sprintf("Reset %s to 0.", item))
+        return
+    }
+
+    if mergeMatch := mergeRegex.FindStringSubmatch(messageLower); mergeMatch != nil {
+        if !bot.requireLevel(channel, nick, LevelModerator) {
+            bot.conn.Privmsg(channel, "You don't have permission to do that.")
+            return
+        }
+        item1 := mergeMatch[1]
+        item2 := mergeMatch[2]
+        if err := bot.mergeItems(item1, item2, channel); err != nil {
+            bot.conn.Privmsg(channel, fmt.Sprintf("Merge failed: %s", err))
+            return
+        }
+        bot.conn.Privmsg(channel, fmt.Sprintf("Merged %s into %s.", item2, item1))
+        return
+    }
+
+    if kickMatch := kickItemRegex.FindStringSubmatch(messageLower); kickMatch != nil {
+        if !bot.requireLevel(channel, nick, LevelModerator) {
+            bot.conn.Privmsg(channel, "You don't have permission to do that.")
+            return
+        }
+        item := kickMatch[1]
+        bot.kickItem(item, channel)
+        bot.conn.Privmsg(channel, fmt.Sprintf("Removed %s.", item))
+        return
+    }
+
+    if revealMatch := revealRegex.FindStringSubmatch(messageLower); revealMatch != nil {
+        if !bot.requireLevel(channel, nick, LevelModerator) {
+            bot.conn.Privmsg(channel, "You don't have permission to do that.")
+            return
+        }
+        item := revealMatch[1]
+        page := 1
+        if revealMatch[2] != "" {
+            fmt.Sscanf(revealMatch[2], "%d", &page)
+        }
+        action := parseAction(revealMatch[3])
+        entries, err := bot.revealLog(item, page, action)
+        if err != nil {
+            bot.conn.Privmsg(channel, fmt.Sprintf("Reveal failed: %s", err))
+            return
+        }
+        if len(entries) == 0 {
+            bot.conn.Privmsg(channel, fmt.Sprintf("No log entries for %s on page %d.", item, page))
+            return
+        }
+        for _, e := range entries {
+            bot.conn.Privmsg(channel, formatLogEntry(e))
+        }
+        return
+    }
+
+    if banMatch := banItemRegex.FindStringSubmatch(messageLower); banMatch != nil {
+        if !bot.requireLevel(channel, nick, LevelAdmin) {
+            bot.conn.Privmsg(channel, "You don't have permission to do that.")
+            return
+        }
+        item := banMatch[1]
+        bot.banItem(item)
+        bot.conn.Privmsg(channel, fmt.Sprintf("Banned %s from tallying.", item))
+        return
+    }
+
+    if statsRegex.MatchString(messageLower) {
+        if !bot.requireLevel(channel, nick, LevelAdmin) {
+            bot.conn.Privmsg(channel, "You don't have permission to do that.")
+            return
+        }
+        response := fmt.Sprintf("Items: %d, Accounts: %d", bot.itemCount(), bot.accountCount())
+        bot.conn.Privmsg(channel, response)
+        return
+    }
+
+    if rehashRegex.MatchString(messageLower) {
+        if !bot.requireLevel(channel, nick, LevelAdmin) {
+            bot.conn.Privmsg(channel, "You don't have permission to do that.")
+            return
+        }
+        newConfig, err := readConfig()
+        if err != nil {
+            bot.conn.Privmsg(channel, fmt.Sprintf("Rehash failed: %s", err))
+            return
+        }
+        if err := bot.rehash(newConfig); err != nil {
+            bot.conn.Privmsg(channel, fmt.Sprintf("Rehash failed: %s", err))
+            return
+        }
+        bot.conn.Privmsg(channel, "Config rehashed.")
+        return
+    }
+
+    if upgradedbRegex.MatchString(messageLower) {
+        if !bot.requireLevel(channel, nick, LevelSuperAdmin) {
+            bot.conn.Privmsg(channel, "You don't have permission to do that.")
+            return
+        }
+        if err := bot.runMigrations(false); err != nil {
+            bot.conn.Privmsg(channel, fmt.Sprintf("Upgrade failed: %s", err))
+            return
+        }
+        bot.conn.Privmsg(channel, "Database schema is up to date.")
+        return
+    }
+
     if unlinkMatch := unlinkRegex.FindStringSubmatch(messageLower); unlinkMatch != nil {
+        if !bot.requireLevel(channel, nick, LevelRegistered) {
+            bot.conn.Privmsg(channel, "You don't have permission to do that.")
+            return
+        }
         item1 := unlinkMatch[1]
         item2 := unlinkMatch[2]
-        bot.unlinkItems(item1, item2)
+        bot.unlinkItems(item1, item2, channel)
+        bot.logTally(nick, hostmask, channel, item1, "unlink", 0, bot.getChannelTotalScore(item1, channel))
         response := fmt.Sprintf("Unlinked %s and %s.", item1, item2)
         bot.conn.Privmsg(channel, response)
         return
     }
 
     if linkMatch := linkRegex.FindStringSubmatch(messageLower); linkMatch != nil {
-        item1 := linkMatch[1]
-        item2 := linkMatch[2]
-        bot.linkItems(item1, item2)
-        response := fmt.Sprintf("Linked %s and %s.", item1, item2)
+        if !bot.requireLevel(channel, nick, LevelRegistered) {
+            bot.conn.Privmsg(channel, "You don't have permission to do that.")
+            return
+        }
+        pattern1 := linkMatch[1]
+        pattern2 := linkMatch[2]
+        if isGlob(pattern1) || isGlob(pattern2) {
+            items1, err := bot.resolveItems(pattern1)
+            if err != nil {
+                bot.conn.Privmsg(channel, fmt.Sprintf("Link failed: %s", err))
+                return
+            }
+            items2, err := bot.resolveItems(pattern2)
+            if err != nil {
+                bot.conn.Privmsg(channel, fmt.Sprintf("Link failed: %s", err))
+                return
+            }
+            all := append(items1, items2...)
+            if len(all) < 2 {
+                bot.conn.Privmsg(channel, "No items matched those globs.")
+                return
+            }
+            for _, item := range all[1:] {
+                bot.linkItems(all[0], item, channel)
+                bot.logTally(nick, hostmask, channel, all[0], "link", 0, bot.getChannelTotalScore(all[0], channel))
+            }
+            bot.conn.Privmsg(channel, fmt.Sprintf("Linked %d items into one group.", len(all)))
+            return
+        }
+        bot.linkItems(pattern1, pattern2, channel)
+        bot.logTally(nick, hostmask, channel, pattern1, "link", 0, bot.getChannelTotalScore(pattern1, channel))
+        response := fmt.Sprintf("Linked %s and %s.", pattern1, pattern2)
         bot.conn.Privmsg(channel, response)
         return
     }
 
+    if matchMatch := matchRegex.FindStringSubmatch(messageLower); matchMatch != nil {
+        items, err := bot.matchItems(matchMatch[1])
+        if err != nil {
+            bot.conn.Privmsg(channel, fmt.Sprintf("Match failed: %s", err))
+            return
+        }
+        if len(items) == 0 {
+            bot.conn.Privmsg(channel, fmt.Sprintf("No items match %s.", matchMatch[1]))
+            return
+        }
+        var lines []string
+        for _, item := range items {
+            lines = append(lines, fmt.Sprintf("%s [%d]", item, bot.getScore(item, channel)))
+        }
+        bot.conn.Privmsg(channel, strings.Join(lines, ", "))
+        return
+    }
+
     if totalMatch := totalRegex.FindStringSubmatch(messageLower); totalMatch != nil {
         item := totalMatch[1]
-        totalScore := bot.getTotalScore(item)
-        response := fmt.Sprintf("Total score for group including %s: [%d]", item, totalScore)
+        totalScore := bot.getChannelTotalScore(item, channel)
+        response := fmt.Sprintf("Total score for group including %s in %s: [%d]", item, channel, totalScore)
+        bot.conn.Privmsg(channel, response)
+        return
+    }
+
+    if gtotalMatch := gtotalRegex.FindStringSubmatch(messageLower); gtotalMatch != nil {
+        item := gtotalMatch[1]
+        totalScore := bot.getGlobalTotalScore(item)
+        response := fmt.Sprintf("Total score for group including %s across all channels: [%d]", item, totalScore)
         bot.conn.Privmsg(channel, response)
         return
     }
 
+    if topMatch := topRegex.FindStringSubmatch(messageLower); topMatch != nil {
+        n := 5
+        if topMatch[1] != "" {
+            fmt.Sscanf(topMatch[1], "%d", &n)
+        }
+        items, scores := bot.getChannelLeaderboard(channel, n)
+        if len(items) == 0 {
+            bot.conn.Privmsg(channel, fmt.Sprintf("No tallies yet in %s.", channel))
+            return
+        }
+        var lines []string
+        for i, item := range items {
+            lines = append(lines, fmt.Sprintf("%d. %s [%d]", i+1, item, scores[i]))
+        }
+        bot.conn.Privmsg(channel, fmt.Sprintf("Top %d in %s: %s", n, channel, strings.Join(lines, ", ")))
+        return
+    }
+
+    if whoscoredMatch := whoscoredRegex.FindStringSubmatch(messageLower); whoscoredMatch != nil {
+        item := whoscoredMatch[1]
+        nicks, totals, err := bot.whoScored(item, 5)
+        if err != nil {
+            bot.conn.Privmsg(channel, fmt.Sprintf("whoscored failed: %s", err))
+            return
+        }
+        if len(nicks) == 0 {
+            bot.conn.Privmsg(channel, fmt.Sprintf("No history for %s.", item))
+            return
+        }
+        var lines []string
+        for i, n := range nicks {
+            lines = append(lines, fmt.Sprintf("%s (%+d)", n, totals[i]))
+        }
+        bot.conn.Privmsg(channel, fmt.Sprintf("Top contributors to %s: %s", item, strings.Join(lines, ", ")))
+        return
+    }
+
+    if undoRegex.MatchString(messageLower) {
+        item, err := bot.undoLast(nick, hostmask, channel)
+        if err != nil {
+            bot.conn.Privmsg(channel, fmt.Sprintf("Undo failed: %s", err))
+            return
+        }
+        bot.conn.Privmsg(channel, fmt.Sprintf("Undid your last change to %s.", item))
+        return
+    }
+
     if upvoteMatches := upvoteRegex.FindAllStringSubmatch(message, -1); upvoteMatches != nil {
         for _, match := range upvoteMatches {
             item := strings.ToLower(match[1])
+            if bot.isBanned(item) {
+                bot.conn.Privmsg(channel, fmt.Sprintf("%s is banned from tallying.", item))
+                continue
+            }
             operation := match[2]
-            bot.ensureItemExists(item)
-            currentScore := bot.getScore(item)
+            bot.ensureItemExists(item, channel)
+            currentScore := bot.getScore(item, channel)
             var newScore int
             if operation == "++" {
                 newScore = currentScore + 1
             } else {
                 newScore = currentScore - 1
             }
-            bot.updateScore(item, newScore)
+            bot.updateScore(item, channel, newScore)
+            delta := 1
+            action := "increment"
+            if operation == "--" {
+                delta = -1
+                action = "decrement"
+            }
+            bot.logTally(nick, hostmask, channel, item, action, delta, newScore)
             linkedItems := bot.getLinkedItems(item)
             var linkedStr string
             if len(linkedItems) > 0 {
@@ -298,123 +705,188 @@ item++ or item--: Increment/decrement score for item
     }
 }
 
-func readConfig() (Config, error) {
-    var config Config
-    var configPaths []string
 
-    configPaths = append(configPaths, ".tally.conf")
+// setupBotCallbacks wires the IRC callbacks shared by every network: SASL
+// failure, post-registration join/IDENTIFY, invite-join, and message
+// dispatch.
+func setupBotCallbacks(bot *TallyBot) {
+    bot.conn.AddCallback("904", func(e *irc.Event) {
+        log.Fatalf("SASL authentication failed: %s", e.Message())
+    })
+    bot.conn.AddCallback("905", func(e *irc.Event) {
+        log.Fatalf("SASL authentication failed: %s", e.Message())
+    })
 
-    usr, err := user.Current()
-    if err == nil {
-        homeConfigPath := filepath.Join(usr.HomeDir, ".tally.conf")
-        configPaths = append(configPaths, homeConfigPath)
-    }
+    bot.conn.AddCallback("001", func(e *irc.Event) {
+        bot.mu.RLock()
+        nickServPass := bot.network.NickServPass
+        channels := bot.network.Channels
+        bot.mu.RUnlock()
 
-    var file *os.File
-    for _, path := range configPaths {
-        f, err := os.Open(path)
-        if err == nil {
-            file = f
-            defer file.Close()
-            break
+        if !bot.conn.UseSASL && nickServPass != "" {
+            bot.conn.Privmsg("NickServ", "IDENTIFY "+nickServPass)
         }
-    }
+        for _, channel := range channels {
+            bot.conn.Join(channel)
+        }
+    })
 
-    if file == nil {
-        return config, fmt.Errorf("configuration file .tally.conf not found")
-    }
+    bot.conn.AddCallback("INVITE", func(e *irc.Event) {
+        channel := e.Arguments[len(e.Arguments)-1]
+        bot.conn.Join(channel)
+        key := strings.ToLower(channel)
+        bot.mu.Lock()
+        if !bot.activeChannels[key] {
+            bot.activeChannels[key] = true
+        }
+        bot.mu.Unlock()
+        log.Printf("Joined %s after invite from %s\n", channel, e.Nick)
+    })
 
-    scanner := bufio.NewScanner(file)
-    for scanner.Scan() {
-        line := scanner.Text()
-        line = strings.TrimSpace(line)
-        if len(line) == 0 || strings.HasPrefix(line, "#") {
-            continue
+    bot.conn.AddCallback("PRIVMSG", func(e *irc.Event) {
+        nick := e.Nick
+        hostmask := fmt.Sprintf("%s@%s", e.User, e.Host)
+        message := e.Message()
+        channel := e.Arguments[0]
+        bot.handleMessage(channel, nick, hostmask, message)
+    })
+}
+
+func main() {
+    initdb := flag.Bool("initdb", false, "initialize the database schema and exit")
+    upgradedb := flag.Bool("upgradedb", false, "apply pending database migrations and exit")
+    dryRun := flag.Bool("dry-run", false, "with -upgradedb, print pending migrations without applying them")
+    grant := flag.String("grant", "", "grant <account>:<level> access and exit, e.g. -grant=alice:superadmin (account must already be !register'd)")
+    flag.Parse()
+
+    if *grant != "" {
+        account, levelName, ok := strings.Cut(*grant, ":")
+        if !ok {
+            fmt.Println("Usage: -grant=<account>:<level> (e.g. -grant=alice:superadmin)")
+            os.Exit(1)
         }
-        parts := strings.SplitN(line, "=", 2)
-        if len(parts) != 2 {
-            continue
+        level, err := parseLevel(levelName)
+        if err != nil {
+            fmt.Println(err)
+            os.Exit(1)
+        }
+        db, err := openDB(dbPath)
+        if err != nil {
+            fmt.Printf("Error opening database: %v\n", err)
+            os.Exit(1)
         }
-        key := strings.TrimSpace(parts[0])
-        value := strings.TrimSpace(parts[1])
-        switch key {
-        case "nickname":
-            config.Nickname = value
-        case "server":
-            config.Server = value
-        case "channels":
-            config.Channels = strings.Split(value, ",")
-        case "active_channels":
-            config.ActiveChannels = strings.Split(value, ",")
-        case "use_tls":
-            valueLower := strings.ToLower(value)
-            config.UseTLS = valueLower == "true" || valueLower == "yes" || valueLower == "1"
-        default:
-            fmt.Printf("Unknown configuration key: %s\n", key)
+        bot := &TallyBot{db: db}
+        if err := bot.setAccountLevel(account, level); err != nil {
+            fmt.Println(err)
+            os.Exit(1)
         }
-    }
-    if err := scanner.Err(); err != nil {
-        return config, err
+        fmt.Printf("Granted %s level %s.\n", account, level)
+        return
     }
 
-    if config.Nickname == "" {
-        config.Nickname = "TallyBot"
-    }
-    if config.Server == "" {
-        config.Server = "irc.libera.chat:6667"
-    }
-    if len(config.Channels) == 0 {
-        config.Channels = []string{"#tallybot"}
-    }
-    if len(config.ActiveChannels) == 0 {
-        config.ActiveChannels = config.Channels
+    if *initdb || *upgradedb {
+        config, err := readConfig()
+        if err != nil {
+            fmt.Printf("Error reading configuration: %v\n", err)
+            os.Exit(1)
+        }
+        db, err := openDB(dbPath)
+        if err != nil {
+            fmt.Printf("Error opening database: %v\n", err)
+            os.Exit(1)
+        }
+        bot := &TallyBot{db: db, appConfig: config}
+        if err := bot.runMigrations(*dryRun); err != nil {
+            fmt.Printf("Migration failed: %v\n", err)
+            os.Exit(1)
+        }
+        return
     }
 
-    return config, nil
-}
-
-func main() {
     config, err := readConfig()
     if err != nil {
         fmt.Printf("Error reading configuration: %v\n", err)
         return
     }
 
-    fmt.Printf("Starting bot with nickname '%s' on server '%s', joining channels '%s'\n",
-        config.Nickname, config.Server, strings.Join(config.Channels, ", "))
-    fmt.Printf("Bot will actively respond in: '%s'\n",
-        strings.Join(config.ActiveChannels, ", "))
+    db, err := openDB(dbPath)
+    if err != nil {
+        fmt.Printf("Error opening database: %v\n", err)
+        return
+    }
 
-    bot := NewTallyBot(config.Nickname, config.Server, config.Channels, config.ActiveChannels, config.UseTLS)
-    bot.initializeDatabase()
+    // db, maskDB, identified, and metrics are shared across every
+    // network so tallies stay consistent no matter which network a
+    // ++/-- came in on.
+    setup := &TallyBot{db: db, appConfig: config}
+    if err := setup.runMigrations(false); err != nil {
+        fmt.Printf("Migration failed: %v\n", err)
+        return
+    }
+    if err := setup.initMaskIndex(); err != nil {
+        fmt.Printf("Error building match index: %v\n", err)
+        return
+    }
 
-    bot.conn.AddCallback("001", func(e *irc.Event) {
-        for _, channel := range config.Channels {
-            bot.conn.Join(channel)
-        }
-    })
+    sharedIdentified := make(map[string]string)
+    sharedMetrics := newMetrics()
 
-    bot.conn.AddCallback("INVITE", func(e *irc.Event) {
-        channel := e.Arguments[len(e.Arguments)-1]
-        bot.conn.Join(channel)
-        if !bot.activeChannels[channel] {
-            bot.activeChannels[channel] = true
+    var bots []*TallyBot
+    for _, network := range config.Networks {
+        fmt.Printf("Starting bot with nickname '%s' on server '%s', joining channels '%s'\n",
+            network.Nickname, network.Server, strings.Join(network.Channels, ", "))
+        fmt.Printf("Bot will actively respond in: '%s'\n",
+            strings.Join(network.ActiveChannels, ", "))
+        if network.SASLUser != "" {
+            fmt.Printf("Authenticating via SASL as '%s'\n", network.SASLUser)
+        } else if network.NickServPass != "" {
+            fmt.Printf("Will IDENTIFY to NickServ after connecting\n")
         }
-        log.Printf("Joined %s after invite from %s\n", channel, e.Nick)
-    })
 
-    bot.conn.AddCallback("PRIVMSG", func(e *irc.Event) {
-        nick := e.Nick
-        message := e.Message()
-        channel := e.Arguments[0]
-        bot.handleMessage(channel, nick, message)
-    })
+        bot := NewTallyBot(network, config)
+        bot.db = setup.db
+        bot.maskDB = setup.maskDB
+        bot.identified = sharedIdentified
+        bot.metrics = sharedMetrics
+        setupBotCallbacks(bot)
+        bots = append(bots, bot)
+    }
 
-    err = bot.conn.Connect(config.Server)
-    if err != nil {
-        fmt.Printf("Failed to connect to IRC server: %s\n", err)
-        return
+    if config.HTTPListen != "" {
+        fmt.Printf("Serving HTTP status/leaderboard on '%s'\n", config.HTTPListen)
+        go bots[0].serveHTTP(config.HTTPListen)
     }
 
-    bot.conn.Loop()
+    hangup := make(chan os.Signal, 1)
+    signal.Notify(hangup, syscall.SIGHUP)
+    go func() {
+        for range hangup {
+            newConfig, err := readConfig()
+            if err != nil {
+                log.Printf("Rehash failed: %s", err)
+                continue
+            }
+            for _, bot := range bots {
+                if err := bot.rehash(newConfig); err != nil {
+                    log.Printf("Rehash failed for %s: %s", bot.network.Name, err)
+                }
+            }
+            log.Println("Config rehashed via SIGHUP")
+        }
+    }()
+
+    var wg sync.WaitGroup
+    for _, bot := range bots {
+        bot.wg = &wg
+        wg.Add(1)
+        go func(bot *TallyBot) {
+            defer wg.Done()
+            if err := bot.conn.Connect(bot.network.Server); err != nil {
+                fmt.Printf("Failed to connect to IRC server %s: %s\n", bot.network.Server, err)
+                return
+            }
+            bot.conn.Loop()
+        }(bot)
+    }
+    wg.Wait()
 }